@@ -0,0 +1,42 @@
+package retention
+
+import "time"
+
+// deadlineEntry is a single key's position in the scheduler's deadline heap.
+type deadlineEntry struct {
+	key      string
+	deadline time.Time
+	index    int
+}
+
+// deadlineHeap is a container/heap.Interface over deadlineEntry, ordered so
+// that the entry with the soonest deadline is always at the root. It lets
+// the scheduler find the next key to execute, and update a key's deadline
+// in place, without scanning every key on every tick.
+type deadlineHeap []*deadlineEntry
+
+func (h deadlineHeap) Len() int { return len(h) }
+
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	entry := x.(*deadlineEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
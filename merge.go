@@ -0,0 +1,39 @@
+package retention
+
+// MergeLast discards the existing value and keeps incoming, so a key's
+// collapsed value is always the most recently arrived one.
+func MergeLast(existing, incoming interface{}) interface{} {
+	return incoming
+}
+
+// MergeSum adds incoming to existing for the numeric types BatchCollapse
+// values commonly use (int, int64 and float64). If existing and incoming
+// aren't the same one of those types, existing is returned unchanged.
+func MergeSum(existing, incoming interface{}) interface{} {
+	switch e := existing.(type) {
+	case int:
+		if i, ok := incoming.(int); ok {
+			return e + i
+		}
+	case int64:
+		if i, ok := incoming.(int64); ok {
+			return e + i
+		}
+	case float64:
+		if i, ok := incoming.(float64); ok {
+			return e + i
+		}
+	}
+	return existing
+}
+
+// MergeAppend accumulates every incoming value for a key into a
+// []interface{}, seeding the slice with the first value if existing isn't
+// already one.
+func MergeAppend(existing, incoming interface{}) interface{} {
+	values, ok := existing.([]interface{})
+	if !ok {
+		values = []interface{}{existing}
+	}
+	return append(values, incoming)
+}
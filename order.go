@@ -0,0 +1,54 @@
+package retention
+
+// orderNode is a node in the intrusive doubly-linked list that tracks the
+// order keys first arrived in, oldest at the head, so OverflowDropOldest
+// and OverflowFlushNow can find their candidate in O(1) instead of scanning
+// Values.
+type orderNode struct {
+	key        string
+	prev, next *orderNode
+}
+
+// pushOrder appends key to the tail of the arrival-order list. Must be
+// called with bc.mutex held.
+func (bc *BatchCollapse) pushOrder(key string) {
+	node := &orderNode{key: key}
+	if bc.orderTail == nil {
+		bc.orderHead = node
+	} else {
+		bc.orderTail.next = node
+		node.prev = bc.orderTail
+	}
+	bc.orderTail = node
+	bc.orderNodes[key] = node
+}
+
+// removeOrder unlinks key from the arrival-order list. Must be called with
+// bc.mutex held.
+func (bc *BatchCollapse) removeOrder(key string) {
+	node, ok := bc.orderNodes[key]
+	if !ok {
+		return
+	}
+	delete(bc.orderNodes, key)
+
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		bc.orderHead = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		bc.orderTail = node.prev
+	}
+}
+
+// oldestKey returns the longest-held key, if any. Must be called with
+// bc.mutex held.
+func (bc *BatchCollapse) oldestKey() (string, bool) {
+	if bc.orderHead == nil {
+		return "", false
+	}
+	return bc.orderHead.key, true
+}
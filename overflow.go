@@ -0,0 +1,102 @@
+package retention
+
+// OverflowPolicy controls what Collapse does when a new key would push the
+// number of held keys past Config.MaxKeys.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Collapse block until a key is freed (by being
+	// flushed or dropped) or the BatchCollapse is stopped. The zero value,
+	// so a Config that sets MaxKeys without an OverflowPolicy blocks rather
+	// than silently dropping data.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the incoming value without storing it.
+	OverflowDropNewest
+	// OverflowDropOldest evicts the longest-held key to make room.
+	OverflowDropOldest
+	// OverflowFlushNow forces an immediate execution of the longest-held
+	// key, as if its retention window had already elapsed.
+	OverflowFlushNow
+)
+
+// Stats reports point-in-time counters for a BatchCollapse.
+type Stats struct {
+	// Collapsed is the number of Collapse calls that were stored or merged.
+	Collapsed int
+	// Flushed is the number of keys ExecuteFunc has successfully processed.
+	Flushed int
+	// Dropped is the number of keys discarded without being flushed, by the
+	// overflow policy, because ExecuteFunc returned an error wrapping
+	// ErrDoNotRetry, or because they exhausted their retries.
+	Dropped int
+}
+
+// Stats returns a snapshot of the BatchCollapse's counters.
+func (bc *BatchCollapse) Stats() Stats {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.stats
+}
+
+// Len returns the number of keys currently held.
+func (bc *BatchCollapse) Len() int {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return len(bc.Values)
+}
+
+// makeRoom applies OverflowPolicy until there is room for a new key, or
+// decides the incoming value should not be stored at all. Must be called
+// with bc.mutex held, for a key that does not already exist; it may release
+// and reacquire the lock. Returns false if the caller should not insert.
+func (bc *BatchCollapse) makeRoom(key string, value interface{}) bool {
+	for bc.MaxKeys > 0 && len(bc.Values) >= bc.MaxKeys {
+		switch bc.OverflowPolicy {
+		case OverflowDropNewest:
+			bc.drop(key, value, "overflow: drop newest")
+			return false
+
+		case OverflowDropOldest:
+			oldest, ok := bc.oldestKey()
+			if !ok {
+				return true
+			}
+			bc.drop(oldest, bc.Values[oldest], "overflow: drop oldest")
+			bc.forgetKey(oldest)
+
+		case OverflowFlushNow:
+			oldest, ok := bc.oldestKey()
+			if !ok {
+				return true
+			}
+			bc.unschedule(oldest)
+			bc.mutex.Unlock()
+			bc.executeKey(oldest)
+			bc.mutex.Lock()
+
+			// executeKey may have left oldest in place to retry a failed
+			// ExecuteFunc call; that wouldn't free any room, so drop it
+			// instead of flushing forever.
+			if value, stillHeld := bc.Values[oldest]; stillHeld {
+				bc.drop(oldest, value, "overflow: flush failed, dropping")
+				bc.forgetKey(oldest)
+			}
+
+		default: // OverflowBlock
+			if bc.ctx.Err() != nil {
+				return false
+			}
+			bc.cond.Wait()
+		}
+	}
+	return true
+}
+
+// drop records a dropped key and invokes OnDrop. Must be called with
+// bc.mutex held.
+func (bc *BatchCollapse) drop(key string, value interface{}, reason string) {
+	bc.stats.Dropped++
+	if bc.OnDrop != nil {
+		bc.OnDrop(key, value, reason)
+	}
+}
@@ -0,0 +1,121 @@
+// Package pubsub wires a retention.BatchCollapse directly to a Google Cloud
+// Pub/Sub subscription, so that redelivered or duplicate messages sharing a
+// key are collapsed into a single execution.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+
+	retention "github.com/johan-lejdung/batch-collapse-retention"
+)
+
+// KeyFunc derives the collapse key for an incoming message, eg. from one of
+// its attributes.
+type KeyFunc func(msg *pubsub.Message) string
+
+// Consume starts sub.Receive and forwards every message into a
+// retention.BatchCollapse keyed by keyFunc. A message is only Acked once
+// conf.ExecuteFunc has successfully processed the collapsed value its key
+// produced; a terminal error (one wrapping retention.ErrDoNotRetry) Nacks
+// the group instead, as does a key being dropped for any other reason (eg.
+// MaxRetryDuration or an overflow policy), while any other error leaves the
+// messages tracked so they are acked or nacked once the retry subsystem
+// settles the key.
+//
+// conf.ExecuteFunc and conf.OnDrop are both overwritten to add the ack/nack
+// bookkeeping described above; callers should instead pass their value-
+// processing logic and drop handling via those fields before calling
+// Consume - they are wrapped, not discarded.
+//
+// sub.Receive runs until ctx is canceled or it errors; either way Consume
+// stops bc once it returns, flushing every pending key.
+func Consume(ctx context.Context, sub *pubsub.Subscription, keyFunc KeyFunc, conf retention.Config) (*retention.BatchCollapse, error) {
+	acks := newAckTracker()
+	process := conf.ExecuteFunc
+	onDrop := conf.OnDrop
+
+	conf.ExecuteFunc = func(key string, value interface{}) error {
+		var err error
+		if process != nil {
+			err = process(key, value)
+		}
+
+		switch {
+		case err == nil:
+			acks.ack(key)
+		case errors.Is(err, retention.ErrDoNotRetry):
+			acks.nack(key)
+		}
+
+		return err
+	}
+
+	conf.OnDrop = func(key string, value interface{}, reason string) {
+		if onDrop != nil {
+			onDrop(key, value, reason)
+		}
+		acks.nack(key)
+	}
+
+	bc := retention.CreateBatchCollapse(conf)
+	if err := bc.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			key := keyFunc(msg)
+			acks.track(key, msg)
+			bc.Collapse(key, msg)
+		})
+		bc.Stop()
+	}()
+
+	return bc, nil
+}
+
+// ackTracker keeps the set of *pubsub.Message aggregated under each collapse
+// key so the whole group can be acknowledged once ExecuteFunc has run.
+type ackTracker struct {
+	mutex    sync.Mutex
+	messages map[string][]*pubsub.Message
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{messages: make(map[string][]*pubsub.Message)}
+}
+
+func (a *ackTracker) track(key string, msg *pubsub.Message) {
+	a.mutex.Lock()
+	a.messages[key] = append(a.messages[key], msg)
+	a.mutex.Unlock()
+}
+
+// ack acknowledges every message tracked under key and forgets about it.
+func (a *ackTracker) ack(key string) {
+	a.mutex.Lock()
+	msgs := a.messages[key]
+	delete(a.messages, key)
+	a.mutex.Unlock()
+
+	for _, msg := range msgs {
+		msg.Ack()
+	}
+}
+
+// nack negatively acknowledges every message tracked under key and forgets
+// about it, requesting Pub/Sub redeliver them.
+func (a *ackTracker) nack(key string) {
+	a.mutex.Lock()
+	msgs := a.messages[key]
+	delete(a.messages, key)
+	a.mutex.Unlock()
+
+	for _, msg := range msgs {
+		msg.Nack()
+	}
+}
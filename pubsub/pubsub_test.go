@@ -0,0 +1,206 @@
+package pubsub_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	retention "github.com/johan-lejdung/batch-collapse-retention"
+	rpubsub "github.com/johan-lejdung/batch-collapse-retention/pubsub"
+)
+
+// ackRecorder is a pstest.Reactor that records the outcome of every
+// Acknowledge and ModifyAckDeadline RPC the fake server receives, without
+// altering how the server actually handles them (it always reports
+// handled=false so the real logic still runs).
+type ackRecorder struct {
+	mutex  sync.Mutex
+	acked  int
+	nacked int // ack IDs in ModifyAckDeadline calls requesting an immediate redelivery
+}
+
+func (r *ackRecorder) React(req interface{}) (bool, interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch req := req.(type) {
+	case *pubsubpb.AcknowledgeRequest:
+		r.acked += len(req.AckIds)
+	case *pubsubpb.ModifyAckDeadlineRequest:
+		if req.AckDeadlineSeconds == 0 {
+			r.nacked += len(req.AckIds)
+		}
+	}
+	return false, nil, nil
+}
+
+func (r *ackRecorder) counts() (acked, nacked int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.acked, r.nacked
+}
+
+// newTestClient starts a pstest fake server reacting through recorder and
+// returns a connected *pubsub.Client and a cleanup func that closes the
+// client, its connection and the server.
+func newTestClient(t *testing.T, recorder *ackRecorder) (*gpubsub.Client, func()) {
+	t.Helper()
+
+	srv := pstest.NewServer(
+		pstest.ServerReactorOption{FuncName: "Acknowledge", Reactor: recorder},
+		pstest.ServerReactorOption{FuncName: "ModifyAckDeadline", Reactor: recorder},
+	)
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	assert.NoError(t, err)
+
+	client, err := gpubsub.NewClient(context.Background(), "test-project", option.WithGRPCConn(conn))
+	assert.NoError(t, err)
+
+	return client, func() {
+		client.Close()
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func keyFromAttribute(msg *gpubsub.Message) string {
+	return msg.Attributes["key"]
+}
+
+func TestConsume_AcksOnceExecuteSucceeds(t *testing.T) {
+	recorder := &ackRecorder{}
+	client, cleanup := newTestClient(t, recorder)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topic, err := client.CreateTopic(ctx, "topic1")
+	assert.NoError(t, err)
+	sub, err := client.CreateSubscription(ctx, "sub1", gpubsub.SubscriptionConfig{Topic: topic})
+	assert.NoError(t, err)
+
+	executed := make(chan string, 1)
+	bc, err := rpubsub.Consume(ctx, sub, keyFromAttribute, retention.Config{
+		RetentionDuration: 5 * time.Millisecond,
+		MaxDuration:       time.Second,
+		ExecuteFunc: func(key string, value interface{}) error {
+			executed <- key
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+
+	result := topic.Publish(ctx, &gpubsub.Message{Attributes: map[string]string{"key": "k1"}})
+	_, err = result.Get(ctx)
+	assert.NoError(t, err)
+
+	select {
+	case key := <-executed:
+		assert.Equal(t, "k1", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was never collapsed and executed")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if acked, _ := recorder.counts(); acked >= 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	acked, nacked := recorder.counts()
+	assert.Equal(t, 1, acked)
+	assert.Equal(t, 0, nacked)
+
+	assert.NoError(t, bc.Stop())
+}
+
+func TestConsume_NacksOnDroppedKey(t *testing.T) {
+	recorder := &ackRecorder{}
+	client, cleanup := newTestClient(t, recorder)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topic, err := client.CreateTopic(ctx, "topic2")
+	assert.NoError(t, err)
+	sub, err := client.CreateSubscription(ctx, "sub2", gpubsub.SubscriptionConfig{Topic: topic})
+	assert.NoError(t, err)
+
+	var dropped []string
+	var mutex sync.Mutex
+
+	bc, err := rpubsub.Consume(ctx, sub, keyFromAttribute, retention.Config{
+		RetentionDuration: time.Minute,
+		MaxDuration:       time.Minute,
+		MaxKeys:           1,
+		OverflowPolicy:    retention.OverflowDropNewest,
+		OnDrop: func(key string, value interface{}, reason string) {
+			mutex.Lock()
+			dropped = append(dropped, key)
+			mutex.Unlock()
+		},
+		ExecuteFunc: func(key string, value interface{}) error {
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+
+	publish := func(key string) {
+		result := topic.Publish(ctx, &gpubsub.Message{Attributes: map[string]string{"key": key}})
+		_, err := result.Get(ctx)
+		assert.NoError(t, err)
+	}
+
+	// Publish k1 and wait for it to actually be collapsed before publishing
+	// k2, so MaxKeys=1 deterministically makes k2 (not k1) the overflowing
+	// key regardless of which goroutine sub.Receive happens to deliver on.
+	publish("k1")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !bc.KeyExists("k1") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, bc.KeyExists("k1"))
+
+	publish("k2")
+
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		n := len(dropped)
+		mutex.Unlock()
+		if n >= 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	assert.Equal(t, []string{"k2"}, dropped)
+	mutex.Unlock()
+
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, nacked := recorder.counts(); nacked >= 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, nacked := recorder.counts()
+	assert.Equal(t, 1, nacked)
+
+	assert.NoError(t, bc.Stop())
+}
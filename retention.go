@@ -1,25 +1,44 @@
 package retention
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 // BatchCollapse is used to collapse multiple values from a similar batch (eg. same pubsub messages) into a single value
 type BatchCollapse struct {
-	Values     map[string]interface{}
-	IsCanceled bool
+	Values map[string]interface{}
 	Config
 
-	lastExec  time.Time
-	nextExec  time.Time
+	firstSeen  map[string]time.Time
+	retries    map[string]*retryState
+	generation map[string]int
+
+	schedule deadlineHeap
+	entries  map[string]*deadlineEntry
+	wake     chan struct{}
+
+	orderHead, orderTail *orderNode
+	orderNodes           map[string]*orderNode
+	stats                Stats
+
+	state         int32 // atomic, one of the serviceState constants
+	signalChannel chan os.Signal
+	stopping      chan struct{}
+	done          chan struct{}
+
+	ctx       context.Context
 	ctxCancel context.CancelFunc
 	mutex     sync.Mutex
+	cond      *sync.Cond
 }
 
 // Config contains the configuration needed to setup the BatchCollapse with `CreateBatchCollapse()`
@@ -28,92 +47,387 @@ type Config struct {
 	RetentionDuration time.Duration
 	// MaxDuration is the max duration until a execution occurs
 	MaxDuration time.Duration
-	// ExecuteFunc will be called with the Value if the value is set.
-	ExecuteFunc      func(interface{})
+	// ExecuteFunc will be called with the key and its collapsed value once the
+	// retention window for that key has elapsed. A non-nil return is treated
+	// as a failed attempt and retried with backoff unless it wraps
+	// ErrDoNotRetry.
+	ExecuteFunc      func(key string, value interface{}) error
 	RegisterShutdown bool
+
+	// InitialBackoff is the delay before the first retry of a failed
+	// ExecuteFunc call. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff between retries. Defaults to
+	// 30 seconds.
+	MaxBackoff time.Duration
+	// MaxRetryDuration is the total time a key may spend retrying before it
+	// is given up on and dropped. Defaults to 15 minutes.
+	MaxRetryDuration time.Duration
+	// OnRetry, if set, is called after a failed ExecuteFunc invocation with
+	// the error it returned and the delay until the next attempt. It is
+	// also called, with a zero nextAttempt, when a key is given up on because
+	// its next attempt would land past MaxRetryDuration since its first
+	// failure.
+	OnRetry func(key string, err error, nextAttempt time.Duration)
+
+	// MergeFunc decides how an incoming value is combined with a key's
+	// existing collapsed value. It is called under the lock, so it must not
+	// call back into the BatchCollapse. Defaults to nil, which keeps the
+	// existing value and discards incoming - the original collapse
+	// behavior. See MergeLast, MergeSum and MergeAppend for common
+	// alternatives.
+	MergeFunc func(existing, incoming interface{}) interface{}
+
+	// MaxKeys caps the number of distinct keys held at once. Zero (the
+	// default) means unbounded.
+	MaxKeys int
+	// OverflowPolicy decides what Collapse does when a new key would push
+	// the number of held keys past MaxKeys. Defaults to OverflowBlock.
+	OverflowPolicy OverflowPolicy
+	// OnDrop, if set, is called whenever OverflowPolicy or the retry
+	// subsystem discards a key's value without ever flushing it.
+	OnDrop func(key string, value interface{}, reason string)
 }
 
-// CreateBatchCollapse creates a new instance of BatchCollapse with the help of the provided config
+// CreateBatchCollapse creates a new, unstarted instance of BatchCollapse
+// with the help of the provided config. Call Start to begin collapsing.
 func CreateBatchCollapse(conf Config) *BatchCollapse {
+	if conf.InitialBackoff == 0 {
+		conf.InitialBackoff = defaultInitialBackoff
+	}
+	if conf.MaxBackoff == 0 {
+		conf.MaxBackoff = defaultMaxBackoff
+	}
+	if conf.MaxRetryDuration == 0 {
+		conf.MaxRetryDuration = defaultMaxRetryDuration
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	bc := &BatchCollapse{
-		Values:    make(map[string]interface{}),
-		Config:    conf,
-		lastExec:  time.Now(),
-		nextExec:  time.Now().Add(conf.RetentionDuration),
-		ctxCancel: cancel,
-	}
-
-	if conf.RegisterShutdown {
-		signalChannel := make(chan os.Signal, 2)
-		signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
-		go func() {
-			sig := <-signalChannel
-			switch sig {
-			case os.Interrupt,
-				syscall.SIGKILL,
-				syscall.SIGTERM:
-				bc.Cancel()
-			default:
-				log.Printf("Other signal %v", sig)
-			}
-
-		}()
+		Values:     make(map[string]interface{}),
+		Config:     conf,
+		firstSeen:  make(map[string]time.Time),
+		retries:    make(map[string]*retryState),
+		generation: make(map[string]int),
+		entries:    make(map[string]*deadlineEntry),
+		wake:       make(chan struct{}, 1),
+		orderNodes: make(map[string]*orderNode),
+		stopping:   make(chan struct{}),
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		ctxCancel:  cancel,
 	}
+	bc.cond = sync.NewCond(&bc.mutex)
+	heap.Init(&bc.schedule)
 
-	go bc.executeIfCompleted(ctx)
+	// Wake any Collapse call blocked in OverflowBlock once the instance is
+	// stopped, so it can give up instead of blocking forever.
+	go func() {
+		<-ctx.Done()
+		bc.mutex.Lock()
+		bc.cond.Broadcast()
+		bc.mutex.Unlock()
+	}()
 
 	return bc
 }
 
-// Collapse either collapses a value into a previous set value, or sets the value if nil
-// the method also resets the internal timer for when to execute the collapsed batch
+// Start begins the scheduler loop, and - if RegisterShutdown is set -
+// registers a signal handler that calls Stop on SIGTERM/SIGINT/SIGKILL.
+// Returns ErrAlreadyStarted if called more than once.
+func (bc *BatchCollapse) Start() error {
+	if !atomic.CompareAndSwapInt32(&bc.state, int32(stateNew), int32(stateStarted)) {
+		return ErrAlreadyStarted
+	}
+
+	if bc.RegisterShutdown {
+		bc.signalChannel = make(chan os.Signal, 2)
+		signal.Notify(bc.signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
+		go bc.watchSignals()
+	}
+
+	go bc.run(bc.ctx)
+
+	return nil
+}
+
+// watchSignals calls Stop when a registered signal arrives, and exits
+// without doing so once Stop has already unregistered the signal channel.
+func (bc *BatchCollapse) watchSignals() {
+	select {
+	case sig, ok := <-bc.signalChannel:
+		if !ok {
+			return
+		}
+		switch sig {
+		case os.Interrupt,
+			syscall.SIGKILL,
+			syscall.SIGTERM:
+			bc.Stop()
+		default:
+			log.Printf("Other signal %v", sig)
+		}
+	case <-bc.stopping:
+	}
+}
+
+// Collapse merges value into the key's existing collapsed value via
+// MergeFunc, or sets it if the key hasn't been seen yet, and (re)schedules
+// the key's retention deadline. If the key is new and MaxKeys has been
+// reached, OverflowPolicy decides whether Collapse blocks, drops a value,
+// or forces an immediate flush to make room.
 func (bc *BatchCollapse) Collapse(key string, value interface{}) {
 	bc.mutex.Lock()
-	if !bc.KeyExists(key) {
+	defer bc.mutex.Unlock()
+
+	if bc.keyExists(key) {
+		if bc.MergeFunc != nil {
+			bc.Values[key] = bc.MergeFunc(bc.Values[key], value)
+			bc.generation[key]++
+		}
+	} else {
+		if !bc.makeRoom(key, value) {
+			return
+		}
 		bc.Values[key] = value
+		bc.firstSeen[key] = time.Now()
+		bc.pushOrder(key)
+		bc.generation[key]++
 	}
-	bc.nextExec = time.Now().Add(bc.RetentionDuration)
-	bc.mutex.Unlock()
+
+	bc.stats.Collapsed++
+	bc.scheduleKey(key)
 }
 
-// KeyExists checks if a key exist or not
+// KeyExists reports whether key currently has a collapsed value held.
 func (bc *BatchCollapse) KeyExists(key string) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.keyExists(key)
+}
+
+// keyExists is the lock-free implementation of KeyExists. Must be called
+// with bc.mutex held.
+func (bc *BatchCollapse) keyExists(key string) bool {
 	_, ok := bc.Values[key]
 	return ok
 }
 
-func (bc *BatchCollapse) executeIfCompleted(ctx context.Context) {
-	for true {
-		time.Sleep(10 * time.Millisecond)
+// unschedule removes a key from the deadline heap, if present. Must be
+// called with bc.mutex held.
+func (bc *BatchCollapse) unschedule(key string) {
+	entry, ok := bc.entries[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&bc.schedule, entry.index)
+	delete(bc.entries, key)
+}
+
+// forgetKey removes every trace of a key: its value, retry state,
+// scheduler entry and place in the arrival-order list. Must be called with
+// bc.mutex held. It also wakes any Collapse call blocked in OverflowBlock.
+func (bc *BatchCollapse) forgetKey(key string) {
+	delete(bc.Values, key)
+	delete(bc.firstSeen, key)
+	delete(bc.retries, key)
+	delete(bc.generation, key)
+	bc.removeOrder(key)
+	bc.unschedule(key)
+	bc.cond.Broadcast()
+}
+
+// scheduleKey (re)computes a key's deadline - the earlier of its retention
+// deadline and its MaxDuration deadline, or its retry deadline while it is
+// backing off - and pushes/updates it in the deadline heap. Must be called
+// with bc.mutex held.
+func (bc *BatchCollapse) scheduleKey(key string) {
+	deadline := time.Now().Add(bc.RetentionDuration)
+	if maxDeadline := bc.firstSeen[key].Add(bc.MaxDuration); bc.MaxDuration > 0 && maxDeadline.Before(deadline) {
+		deadline = maxDeadline
+	}
+	if retry, retrying := bc.retries[key]; retrying {
+		deadline = retry.nextAttempt
+	}
+
+	if entry, ok := bc.entries[key]; ok {
+		entry.deadline = deadline
+		heap.Fix(&bc.schedule, entry.index)
+	} else {
+		entry := &deadlineEntry{key: key, deadline: deadline}
+		heap.Push(&bc.schedule, entry)
+		bc.entries[key] = entry
+	}
+
+	select {
+	case bc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the scheduler loop: it sleeps exactly until the soonest deadline in
+// the heap, wakes up the keys due by then, and is nudged early by Collapse
+// whenever a new or updated deadline lands before the one it was sleeping
+// on.
+func (bc *BatchCollapse) run(ctx context.Context) {
+	defer close(bc.done)
+
+	for {
+		bc.mutex.Lock()
+		wait, ok := bc.untilNextDeadline()
+		bc.mutex.Unlock()
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if ok {
+			timer = time.NewTimer(wait)
+			timerC = timer.C
+		}
+
 		select {
 		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
 			log.Println("BatchCollapse: Context canceled - exiting loop")
 			return
-		default:
-			bc.doProcess(false)
+		case <-bc.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-timerC:
+			bc.processDue(false)
 		}
 	}
 }
 
-func (bc *BatchCollapse) doProcess(forceProcess bool) {
+// untilNextDeadline returns how long to sleep until the soonest scheduled
+// key is due. Must be called with bc.mutex held.
+func (bc *BatchCollapse) untilNextDeadline() (time.Duration, bool) {
+	if bc.schedule.Len() == 0 {
+		return 0, false
+	}
+	wait := time.Until(bc.schedule[0].deadline)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// processDue executes every key whose deadline has passed, or - if
+// forceProcess is set - every scheduled key regardless of deadline.
+func (bc *BatchCollapse) processDue(forceProcess bool) {
 	bc.mutex.Lock()
-	for key, value := range bc.Values {
-		if bc.KeyExists(key) && bc.ExecuteFunc != nil &&
-			(forceProcess || bc.nextExec.Before(time.Now()) || bc.lastExec.Add(bc.MaxDuration).Before(time.Now())) {
-			bc.ExecuteFunc(value)
-			bc.lastExec = time.Now()
-			bc.nextExec = time.Now().Add(bc.RetentionDuration)
-			delete(bc.Values, key)
-		}
+	var due []string
+	for bc.schedule.Len() > 0 && (forceProcess || !bc.schedule[0].deadline.After(time.Now())) {
+		entry := heap.Pop(&bc.schedule).(*deadlineEntry)
+		delete(bc.entries, entry.key)
+		due = append(due, entry.key)
+	}
+	bc.mutex.Unlock()
+
+	for _, key := range due {
+		bc.executeKey(key)
 	}
+}
+
+// executeKey runs ExecuteFunc for key, if it still has a value and a
+// function to run it with, and applies the retry subsystem's outcome.
+func (bc *BatchCollapse) executeKey(key string) {
+	bc.mutex.Lock()
+	value, ok := bc.Values[key]
+	generation := bc.generation[key]
+	execute := bc.ExecuteFunc
 	bc.mutex.Unlock()
+
+	if !ok || execute == nil {
+		return
+	}
+
+	err := execute(key, value)
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	// Collapse merged a newer value in while ExecuteFunc was running for
+	// this one; it already rescheduled the key for its own future flush,
+	// so leave it alone instead of discarding what just arrived.
+	if _, stillHeld := bc.Values[key]; !stillHeld || bc.generation[key] != generation {
+		return
+	}
+
+	if err == nil {
+		bc.stats.Flushed++
+		bc.forgetKey(key)
+		return
+	}
+	if errors.Is(err, ErrDoNotRetry) {
+		bc.drop(key, value, "terminal error")
+		bc.forgetKey(key)
+		return
+	}
+
+	retry, retrying := bc.retries[key]
+	if !retrying {
+		retry = &retryState{firstFailure: time.Now()}
+		bc.retries[key] = retry
+	}
+	retry.attempts++
+	delay := backoff(retry.attempts, bc.InitialBackoff, bc.MaxBackoff)
+
+	if time.Since(retry.firstFailure)+delay > bc.MaxRetryDuration {
+		bc.drop(key, value, "max retry duration exceeded")
+		bc.forgetKey(key)
+		if bc.OnRetry != nil {
+			bc.OnRetry(key, err, 0)
+		}
+		return
+	}
+
+	retry.nextAttempt = time.Now().Add(delay)
+	bc.scheduleKey(key)
+	if bc.OnRetry != nil {
+		bc.OnRetry(key, err, delay)
+	}
+}
+
+// Stop cancels the scheduler loop's context and flushes every pending key
+// one last time before returning. Safe to call multiple times; every call
+// after the first returns ErrAlreadyStopped. Should only be called on
+// SIGTERM or when done with the instance.
+func (bc *BatchCollapse) Stop() error {
+	if atomic.CompareAndSwapInt32(&bc.state, int32(stateStarted), int32(stateStopped)) {
+		close(bc.stopping)
+		if bc.signalChannel != nil {
+			signal.Stop(bc.signalChannel)
+		}
+
+		bc.ctxCancel()
+		bc.processDue(true)
+		return nil
+	}
+
+	// Stopping before Start was ever called: there's no scheduler loop to
+	// cancel or flush, but the ctx.Done() goroutine from CreateBatchCollapse
+	// is still waiting to broadcast bc.cond, and makeRoom's OverflowBlock
+	// check relies on bc.ctx.Err() being non-nil once stopped.
+	if atomic.CompareAndSwapInt32(&bc.state, int32(stateNew), int32(stateStopped)) {
+		close(bc.stopping)
+		bc.ctxCancel()
+		close(bc.done)
+		return nil
+	}
+
+	return ErrAlreadyStopped
+}
+
+// IsCanceled reports whether Stop has been called.
+func (bc *BatchCollapse) IsCanceled() bool {
+	return serviceState(atomic.LoadInt32(&bc.state)) == stateStopped
 }
 
-// Cancel will cancel the context, and in effect kill of the loop for the struct, before calling the execute method one last time
-// Should only be called on SIGTERM or when done with the struct instance.
-func (bc *BatchCollapse) Cancel() {
-	bc.ctxCancel()
-	bc.doProcess(true)
-	bc.IsCanceled = true
+// Done returns a channel that is closed once the scheduler loop has
+// exited, which happens shortly after Stop is called.
+func (bc *BatchCollapse) Done() <-chan struct{} {
+	return bc.done
 }
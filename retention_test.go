@@ -1,6 +1,7 @@
 package retention_test
 
 import (
+	"errors"
 	"log"
 	"sync"
 	"testing"
@@ -15,15 +16,397 @@ func TestCollapse(t *testing.T) {
 	bc := retention.CreateBatchCollapse(retention.Config{
 		RetentionDuration: 5 * time.Second,
 		MaxDuration:       60 * time.Second,
-		ExecuteFunc: func(value interface{}) {
-			log.Printf("Executing function with value %v", value)
+		ExecuteFunc: func(key string, value interface{}) error {
+			log.Printf("Executing function with key %v value %v", key, value)
+			return nil
 		},
 	})
+	assert.NoError(t, bc.Start())
 
-	assert.Nil(t, bc.Value)
-	bc.Collapse(10)
-	assert.NotNil(t, bc.Value)
-	assert.Equal(t, 10, bc.Value)
+	assert.False(t, bc.KeyExists("k1"))
+	bc.Collapse("k1", 10)
+	assert.True(t, bc.KeyExists("k1"))
+	assert.Equal(t, 10, bc.Values["k1"])
+}
+
+func TestCollapse__MergeSum(t *testing.T) {
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+		MergeFunc:         retention.MergeSum,
+		ExecuteFunc: func(key string, value interface{}) error {
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 10)
+	bc.Collapse("k1", 5)
+	bc.Collapse("k1", 1)
+
+	assert.Equal(t, 16, bc.Values["k1"])
+}
+
+func TestCollapse__MergeDuringInFlightExecute(t *testing.T) {
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+
+	var mutex sync.Mutex
+	var seen []interface{}
+
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 1 * time.Millisecond,
+		MaxDuration:       60 * time.Second,
+		MergeFunc:         retention.MergeLast,
+		ExecuteFunc: func(key string, value interface{}) error {
+			mutex.Lock()
+			first := len(seen) == 0
+			seen = append(seen, value)
+			mutex.Unlock()
+
+			if first {
+				close(started)
+				<-proceed
+			}
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", "A")
+	<-started
+
+	// Merge a new value in while the first execution (for "A") is still
+	// blocked inside ExecuteFunc.
+	bc.Collapse("k1", "B")
+	close(proceed)
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		for _, v := range seen {
+			if v == "B" {
+				mutex.Unlock()
+				return
+			}
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatal("value merged in during an in-flight execute was never flushed")
+}
+
+func TestExec__RetriesWithBackoffThenSucceeds(t *testing.T) {
+	var mutex sync.Mutex
+	var attempts int
+	var delays []time.Duration
+
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 1 * time.Millisecond,
+		MaxDuration:       60 * time.Second,
+		InitialBackoff:    1 * time.Millisecond,
+		MaxBackoff:        5 * time.Millisecond,
+		MaxRetryDuration:  time.Second,
+		OnRetry: func(key string, err error, nextAttempt time.Duration) {
+			mutex.Lock()
+			delays = append(delays, nextAttempt)
+			mutex.Unlock()
+		},
+		ExecuteFunc: func(key string, value interface{}) error {
+			mutex.Lock()
+			attempts++
+			n := attempts
+			mutex.Unlock()
+
+			if n < 3 {
+				return errors.New("transient failure")
+			}
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) && bc.KeyExists("k1") {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, delays, 2)
+	for _, d := range delays {
+		assert.Greater(t, d, time.Duration(0))
+	}
+	assert.False(t, bc.KeyExists("k1"))
+	assert.Equal(t, 1, bc.Stats().Flushed)
+}
+
+func TestExec__DropsAfterMaxRetryDuration(t *testing.T) {
+	var mutex sync.Mutex
+	var gaveUp bool
+	var dropped []string
+
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 1 * time.Millisecond,
+		MaxDuration:       60 * time.Second,
+		InitialBackoff:    1 * time.Millisecond,
+		MaxBackoff:        2 * time.Millisecond,
+		MaxRetryDuration:  10 * time.Millisecond,
+		OnRetry: func(key string, err error, nextAttempt time.Duration) {
+			if nextAttempt == 0 {
+				mutex.Lock()
+				gaveUp = true
+				mutex.Unlock()
+			}
+		},
+		OnDrop: func(key string, value interface{}, reason string) {
+			mutex.Lock()
+			dropped = append(dropped, key)
+			mutex.Unlock()
+		},
+		ExecuteFunc: func(key string, value interface{}) error {
+			return errors.New("always fails")
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		done := gaveUp
+		mutex.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, gaveUp)
+	assert.Equal(t, []string{"k1"}, dropped)
+	assert.False(t, bc.KeyExists("k1"))
+	assert.Equal(t, 1, bc.Stats().Dropped)
+}
+
+func TestCollapse__OverflowDropOldest(t *testing.T) {
+	var dropped []string
+	var mutex sync.Mutex
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+		MaxKeys:           2,
+		OverflowPolicy:    retention.OverflowDropOldest,
+		OnDrop: func(key string, value interface{}, reason string) {
+			mutex.Lock()
+			dropped = append(dropped, key)
+			mutex.Unlock()
+		},
+		ExecuteFunc: func(key string, value interface{}) error {
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+	bc.Collapse("k2", 2)
+	bc.Collapse("k3", 3)
+
+	assert.Equal(t, 2, bc.Len())
+	assert.False(t, bc.KeyExists("k1"))
+	assert.True(t, bc.KeyExists("k3"))
+
+	mutex.Lock()
+	assert.Equal(t, []string{"k1"}, dropped)
+	mutex.Unlock()
+
+	assert.Equal(t, 1, bc.Stats().Dropped)
+}
+
+func TestCollapse__OverflowDropNewest(t *testing.T) {
+	var dropped []string
+	var mutex sync.Mutex
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+		MaxKeys:           2,
+		OverflowPolicy:    retention.OverflowDropNewest,
+		OnDrop: func(key string, value interface{}, reason string) {
+			mutex.Lock()
+			dropped = append(dropped, key)
+			mutex.Unlock()
+		},
+		ExecuteFunc: func(key string, value interface{}) error {
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+	bc.Collapse("k2", 2)
+	bc.Collapse("k3", 3)
+
+	assert.Equal(t, 2, bc.Len())
+	assert.True(t, bc.KeyExists("k1"))
+	assert.True(t, bc.KeyExists("k2"))
+	assert.False(t, bc.KeyExists("k3"))
+
+	mutex.Lock()
+	assert.Equal(t, []string{"k3"}, dropped)
+	mutex.Unlock()
+
+	assert.Equal(t, 1, bc.Stats().Dropped)
+}
+
+func TestCollapse__OverflowFlushNow(t *testing.T) {
+	var executed []string
+	var mutex sync.Mutex
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+		MaxKeys:           2,
+		OverflowPolicy:    retention.OverflowFlushNow,
+		ExecuteFunc: func(key string, value interface{}) error {
+			mutex.Lock()
+			executed = append(executed, key)
+			mutex.Unlock()
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+	bc.Collapse("k2", 2)
+	bc.Collapse("k3", 3)
+
+	assert.Equal(t, 2, bc.Len())
+	assert.False(t, bc.KeyExists("k1"))
+	assert.True(t, bc.KeyExists("k2"))
+	assert.True(t, bc.KeyExists("k3"))
+
+	mutex.Lock()
+	assert.Equal(t, []string{"k1"}, executed)
+	mutex.Unlock()
+
+	assert.Equal(t, 1, bc.Stats().Flushed)
+	assert.Equal(t, 0, bc.Stats().Dropped)
+}
+
+func TestCollapse__OverflowFlushNow_DropsWhenFlushKeepsFailing(t *testing.T) {
+	var dropped []string
+	var reasons []string
+	var mutex sync.Mutex
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+		MaxKeys:           2,
+		OverflowPolicy:    retention.OverflowFlushNow,
+		OnDrop: func(key string, value interface{}, reason string) {
+			mutex.Lock()
+			dropped = append(dropped, key)
+			reasons = append(reasons, reason)
+			mutex.Unlock()
+		},
+		ExecuteFunc: func(key string, value interface{}) error {
+			return errors.New("always fails")
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+	bc.Collapse("k2", 2)
+	bc.Collapse("k3", 3)
+
+	assert.Equal(t, 2, bc.Len())
+	assert.False(t, bc.KeyExists("k1"))
+	assert.True(t, bc.KeyExists("k2"))
+	assert.True(t, bc.KeyExists("k3"))
+
+	mutex.Lock()
+	assert.Equal(t, []string{"k1"}, dropped)
+	assert.Equal(t, []string{"overflow: flush failed, dropping"}, reasons)
+	mutex.Unlock()
+
+	assert.Equal(t, 1, bc.Stats().Dropped)
+}
+
+func TestCollapse__OverflowBlock_UnblocksWhenRoomFrees(t *testing.T) {
+	executed := make(chan string, 2)
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Millisecond,
+		MaxDuration:       60 * time.Second,
+		MaxKeys:           1,
+		ExecuteFunc: func(key string, value interface{}) error {
+			executed <- key
+			return nil
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+
+	unblocked := make(chan struct{})
+	go func() {
+		bc.Collapse("k2", 2)
+		close(unblocked)
+	}()
+
+	select {
+	case key := <-executed:
+		assert.Equal(t, "k1", key)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("k1 was never flushed to free room for k2")
+	}
+
+	select {
+	case <-unblocked:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Collapse blocked on OverflowBlock never unblocked once room freed")
+	}
+
+	assert.True(t, bc.KeyExists("k2"))
+}
+
+func TestCollapse__OverflowBlock_UnblocksOnStop(t *testing.T) {
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 60 * time.Second,
+		MaxDuration:       60 * time.Second,
+		MaxKeys:           1,
+		ExecuteFunc: func(key string, value interface{}) error {
+			// Always fails, so k1 stays held (retrying) through Stop()'s
+			// forced flush instead of freeing room for k2 on its own; the
+			// unblock under test must come from ctx cancellation.
+			return errors.New("always fails")
+		},
+	})
+	assert.NoError(t, bc.Start())
+
+	bc.Collapse("k1", 1)
+
+	unblocked := make(chan struct{})
+	go func() {
+		bc.Collapse("k2", 2)
+		close(unblocked)
+	}()
+
+	// Give the goroutine time to actually reach cond.Wait() inside makeRoom.
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, bc.Stop())
+
+	select {
+	case <-unblocked:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Collapse blocked on OverflowBlock never unblocked after Stop()")
+	}
+
+	assert.False(t, bc.KeyExists("k2"))
 }
 
 func TestExec(t *testing.T) {
@@ -33,18 +416,20 @@ func TestExec(t *testing.T) {
 	bc := retention.CreateBatchCollapse(retention.Config{
 		RetentionDuration: 1 * time.Millisecond,
 		MaxDuration:       60 * time.Second,
-		ExecuteFunc: func(value interface{}) {
+		ExecuteFunc: func(key string, value interface{}) error {
 			mutex.Lock()
 			testInt = intPtr(11)
 			mutex.Unlock()
-			log.Printf("Executing function with value %v", value)
+			log.Printf("Executing function with key %v value %v", key, value)
+			return nil
 		},
 	})
+	assert.NoError(t, bc.Start())
 
 	mutex.Lock()
 	assert.Equal(t, 10, *testInt)
 	mutex.Unlock()
-	bc.Collapse(10)
+	bc.Collapse("k1", 10)
 
 	time.Sleep(15 * time.Millisecond)
 	mutex.Lock()
@@ -59,20 +444,22 @@ func TestExecMulti(t *testing.T) {
 	bc := retention.CreateBatchCollapse(retention.Config{
 		RetentionDuration: 5 * time.Millisecond,
 		MaxDuration:       60 * time.Second,
-		ExecuteFunc: func(value interface{}) {
+		ExecuteFunc: func(key string, value interface{}) error {
 			mutex.Lock()
 			testInt = intPtr(11)
 			mutex.Unlock()
-			log.Printf("Executing function with value %v", value)
+			log.Printf("Executing function with key %v value %v", key, value)
+			return nil
 		},
 	})
+	assert.NoError(t, bc.Start())
 
 	mutex.Lock()
 	assert.Equal(t, 10, *testInt)
 	mutex.Unlock()
-	bc.Collapse(10)
-	bc.Collapse(10)
-	bc.Collapse(10)
+	bc.Collapse("k1", 10)
+	bc.Collapse("k1", 10)
+	bc.Collapse("k1", 10)
 
 	mutex.Lock()
 	assert.Equal(t, 10, *testInt)
@@ -88,46 +475,88 @@ func intPtr(i int) *int {
 	return &i
 }
 
-func TestCancel__WithExec(t *testing.T) {
+func TestStop__WithExec(t *testing.T) {
 	var testInt *int
 	testInt = intPtr(10)
 	var mutex sync.Mutex
 	bc := retention.CreateBatchCollapse(retention.Config{
 		RetentionDuration: 5 * time.Second,
 		MaxDuration:       60 * time.Second,
-		ExecuteFunc: func(value interface{}) {
+		ExecuteFunc: func(key string, value interface{}) error {
 			mutex.Lock()
 			testInt = intPtr(11)
 			mutex.Unlock()
-			log.Printf("Executing function with value %v", value)
+			log.Printf("Executing function with key %v value %v", key, value)
+			return nil
 		},
 	})
+	assert.NoError(t, bc.Start())
 
 	mutex.Lock()
 	assert.Equal(t, 10, *testInt)
 	mutex.Unlock()
-	bc.Collapse(10)
+	bc.Collapse("k1", 10)
 
-	assert.False(t, bc.IsCanceled)
-	bc.Cancel()
-	assert.True(t, bc.IsCanceled)
+	assert.False(t, bc.IsCanceled())
+	assert.NoError(t, bc.Stop())
+	assert.True(t, bc.IsCanceled())
 
-	time.Sleep(10 * time.Millisecond)
+	<-bc.Done()
 	mutex.Lock()
 	assert.Equal(t, 11, *testInt)
 	mutex.Unlock()
 }
 
-func TestCancel__WithoutExec(t *testing.T) {
+func TestStop__WithoutExec(t *testing.T) {
 	bc := retention.CreateBatchCollapse(retention.Config{
 		RetentionDuration: 5 * time.Second,
 		MaxDuration:       60 * time.Second,
-		ExecuteFunc: func(value interface{}) {
-			log.Printf("Executing function with value %v", value)
+		ExecuteFunc: func(key string, value interface{}) error {
+			log.Printf("Executing function with key %v value %v", key, value)
+			return nil
 		},
 	})
+	assert.NoError(t, bc.Start())
+
+	assert.False(t, bc.IsCanceled())
+	assert.NoError(t, bc.Stop())
+	assert.True(t, bc.IsCanceled())
+}
+
+func TestStart__AlreadyStarted(t *testing.T) {
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+	})
+
+	assert.NoError(t, bc.Start())
+	assert.Equal(t, retention.ErrAlreadyStarted, bc.Start())
+}
+
+func TestStop__BeforeStart(t *testing.T) {
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+	})
+
+	assert.False(t, bc.IsCanceled())
+	assert.NoError(t, bc.Stop())
+	assert.True(t, bc.IsCanceled())
+
+	select {
+	case <-bc.Done():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Done() never closed after Stop() called before Start()")
+	}
+}
+
+func TestStop__AlreadyStopped(t *testing.T) {
+	bc := retention.CreateBatchCollapse(retention.Config{
+		RetentionDuration: 5 * time.Second,
+		MaxDuration:       60 * time.Second,
+	})
 
-	assert.False(t, bc.IsCanceled)
-	bc.Cancel()
-	assert.True(t, bc.IsCanceled)
+	assert.NoError(t, bc.Start())
+	assert.NoError(t, bc.Stop())
+	assert.Equal(t, retention.ErrAlreadyStopped, bc.Stop())
 }
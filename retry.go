@@ -0,0 +1,42 @@
+package retention
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDoNotRetry is a sentinel error ExecuteFunc can wrap (via errors.Is) to
+// signal that a failure is terminal and the value should be dropped instead
+// of going through the retry subsystem, eg. a message that will never
+// process no matter how many times it's retried.
+var ErrDoNotRetry = errors.New("retention: do not retry")
+
+const (
+	defaultInitialBackoff   = 1 * time.Second
+	defaultMaxBackoff       = 30 * time.Second
+	defaultMaxRetryDuration = 15 * time.Minute
+)
+
+// retryState tracks the backoff progress for a single key whose ExecuteFunc
+// call has failed at least once.
+type retryState struct {
+	attempts     int
+	firstFailure time.Time
+	nextAttempt  time.Time
+}
+
+// backoff returns the exponential backoff for the given attempt number
+// (1-indexed), capped at maxBackoff.
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	d := initial
+	if d >= max {
+		return max
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= max {
+			return max
+		}
+	}
+	return d
+}
@@ -0,0 +1,22 @@
+package retention
+
+import "errors"
+
+// serviceState is the lifecycle state of a BatchCollapse, modeled on the
+// Tendermint-style service pattern: new -> started -> stopped, with no way
+// back.
+type serviceState int32
+
+const (
+	stateNew serviceState = iota
+	stateStarted
+	stateStopped
+)
+
+// ErrAlreadyStarted is returned by Start if the BatchCollapse has already
+// been started (or stopped).
+var ErrAlreadyStarted = errors.New("retention: already started")
+
+// ErrAlreadyStopped is returned by Stop if the BatchCollapse has already
+// been stopped.
+var ErrAlreadyStopped = errors.New("retention: already stopped")